@@ -0,0 +1,53 @@
+package main
+
+import (
+	"image"
+	"image/color/palette"
+	"image/draw"
+	"image/gif"
+)
+
+// buildAnimatedMosaic runs the mosaic composer over every frame of src,
+// reusing the same tile index (and tile tree) across frames, and returns
+// the result as a *gif.GIF ready for gif.EncodeAll, with the original
+// per-frame delay and disposal method preserved.
+//
+// Frames are decoded onto a running canvas in the order GIF defines (each
+// frame drawn over whatever's already there) before being mosaic-ified;
+// this handles the common case of GIFs built from full-canvas frames
+// correctly, but the source disposal methods are not applied to the
+// canvas: neither DisposalBackground's clearing nor DisposalPrevious's
+// "restore to the frame before last" is modelled.
+func buildAnimatedMosaic(src *gif.GIF, tiles []imageInfo, tileW, tileH, noRepeatRadius, gridSize int, stabilityThreshold float64) *gif.GIF {
+	tree := buildTileTree(tiles)
+	bounds := image.Rect(0, 0, src.Config.Width, src.Config.Height)
+	canvas := image.NewRGBA(bounds)
+
+	out := &gif.GIF{
+		Image:    make([]*image.Paletted, 0, len(src.Image)),
+		Delay:    make([]int, 0, len(src.Image)),
+		Disposal: make([]byte, 0, len(src.Image)),
+		Config:   src.Config,
+	}
+
+	var prev map[image.Point]cellState
+
+	for i, frame := range src.Image {
+		draw.Draw(canvas, frame.Bounds(), frame, frame.Bounds().Min, draw.Over)
+
+		composed := image.NewRGBA(bounds)
+		draw.Draw(composed, bounds, canvas, bounds.Min, draw.Src)
+
+		mosaicFrame, next := buildMosaicFrame(composed, tileW, tileH, noRepeatRadius, gridSize, tree, prev, stabilityThreshold)
+		prev = next
+
+		paletted := image.NewPaletted(mosaicFrame.Bounds(), palette.Plan9)
+		draw.Draw(paletted, paletted.Bounds(), mosaicFrame, image.Point{}, draw.Src)
+
+		out.Image = append(out.Image, paletted)
+		out.Delay = append(out.Delay, src.Delay[i])
+		out.Disposal = append(out.Disposal, src.Disposal[i])
+	}
+
+	return out
+}
@@ -0,0 +1,115 @@
+// Package lab converts sRGB colors to CIE L*a*b* and measures perceptual
+// distance between them. Matching tiles in Lab space rather than raw sRGB
+// gives noticeably better mosaics: sRGB is not perceptually uniform, so a
+// Euclidean RGB distance under- or over-weights certain hues (greens in
+// particular come out far too similar to each other) and crushes dark
+// tones together.
+package lab
+
+import "math"
+
+// Lab is a color in the CIE L*a*b* color space, using a D65 white point.
+// L ranges roughly 0-100, a and b are unbounded but typically within
+// [-128, 127].
+type Lab struct {
+	L, A, B float64
+}
+
+// sRGB -> linear RGB -> XYZ (D65) -> Lab, following the standard
+// definitions from the CIE and IEC 61966-2-1 (sRGB) specs.
+
+// srgbToXYZ is the standard sRGB (D65) to XYZ matrix.
+var srgbToXYZ = [3][3]float64{
+	{0.4124564, 0.3575761, 0.1804375},
+	{0.2126729, 0.7151522, 0.0721750},
+	{0.0193339, 0.1191920, 0.9503041},
+}
+
+// whiteD65 is the D65 reference white in XYZ, used to normalize before the
+// XYZ -> Lab nonlinearity is applied.
+var whiteD65 = [3]float64{0.95047, 1.00000, 1.08883}
+
+// expand undoes the sRGB gamma encoding, returning a linear-light value.
+func expand(c float64) float64 {
+	if c <= 0.04045 {
+		return c / 12.92
+	}
+	return math.Pow((c+0.055)/1.055, 2.4)
+}
+
+// f is the nonlinearity used when converting XYZ to Lab.
+func f(t float64) float64 {
+	const delta = 6.0 / 29.0
+	if t > delta*delta*delta {
+		return math.Cbrt(t)
+	}
+	return t/(3*delta*delta) + 4.0/29.0
+}
+
+// FromSRGB converts a normalized sRGB color (each component in [0, 1]) to
+// CIE L*a*b*.
+func FromSRGB(r, g, b float64) Lab {
+	lr, lg, lb := expand(r), expand(g), expand(b)
+
+	x := srgbToXYZ[0][0]*lr + srgbToXYZ[0][1]*lg + srgbToXYZ[0][2]*lb
+	y := srgbToXYZ[1][0]*lr + srgbToXYZ[1][1]*lg + srgbToXYZ[1][2]*lb
+	z := srgbToXYZ[2][0]*lr + srgbToXYZ[2][1]*lg + srgbToXYZ[2][2]*lb
+
+	fx := f(x / whiteD65[0])
+	fy := f(y / whiteD65[1])
+	fz := f(z / whiteD65[2])
+
+	return Lab{
+		L: 116*fy - 16,
+		A: 500 * (fx - fy),
+		B: 200 * (fy - fz),
+	}
+}
+
+// FromRGBA64 converts the 16-bit-per-channel sRGB values returned by
+// color.Color.RGBA() (each in [0, 65535]) to CIE L*a*b*.
+func FromRGBA64(r, g, b uint32) Lab {
+	return FromSRGB(float64(r)/65535.0, float64(g)/65535.0, float64(b)/65535.0)
+}
+
+// DeltaE76 is the Euclidean distance between two Lab colors, as defined by
+// the original 1976 CIE color difference formula. It's cheap and good
+// enough for most mosaic matching, though it over-weights saturated colors
+// relative to human perception compared to CIE94 or CIEDE2000.
+func DeltaE76(a, b Lab) float64 {
+	dl := a.L - b.L
+	da := a.A - b.A
+	db := a.B - b.B
+	return math.Sqrt(dl*dl + da*da + db*db)
+}
+
+// DeltaE94 is the CIE94 color difference formula, which rescales the a*/b*
+// contribution by the chroma of the reference color to better match
+// perceived difference for saturated colors. a is treated as the reference
+// color (e.g. the target cell) and b as the sample being compared against it.
+func DeltaE94(a, b Lab) float64 {
+	const kL, k1, k2 = 1.0, 0.045, 0.015
+
+	c1 := math.Hypot(a.A, a.B)
+	c2 := math.Hypot(b.A, b.B)
+	dc := c1 - c2
+
+	dl := a.L - b.L
+	da := a.A - b.A
+	db := a.B - b.B
+
+	dh2 := da*da + db*db - dc*dc
+	if dh2 < 0 {
+		dh2 = 0
+	}
+
+	sl := 1.0
+	sc := 1 + k1*c1
+	sh := 1 + k2*c1
+
+	return math.Sqrt(
+		(dl/(kL*sl))*(dl/(kL*sl)) +
+			(dc/sc)*(dc/sc) +
+			dh2/(sh*sh),
+	)
+}
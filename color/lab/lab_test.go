@@ -0,0 +1,65 @@
+package lab
+
+import (
+	"math"
+	"testing"
+)
+
+func approxEqual(a, b, tol float64) bool {
+	return math.Abs(a-b) <= tol
+}
+
+func TestFromSRGBWhiteAndBlack(t *testing.T) {
+	white := FromSRGB(1, 1, 1)
+	if !approxEqual(white.L, 100, 0.1) || !approxEqual(white.A, 0, 0.1) || !approxEqual(white.B, 0, 0.1) {
+		t.Fatalf("white = %+v, want L=100 A=0 B=0", white)
+	}
+
+	black := FromSRGB(0, 0, 0)
+	if !approxEqual(black.L, 0, 0.1) || !approxEqual(black.A, 0, 0.1) || !approxEqual(black.B, 0, 0.1) {
+		t.Fatalf("black = %+v, want L=0 A=0 B=0", black)
+	}
+}
+
+func TestFromSRGBRed(t *testing.T) {
+	// Reference value for pure sRGB red, D65 white point.
+	red := FromSRGB(1, 0, 0)
+	want := Lab{L: 53.24, A: 80.09, B: 67.20}
+	if !approxEqual(red.L, want.L, 0.1) || !approxEqual(red.A, want.A, 0.1) || !approxEqual(red.B, want.B, 0.1) {
+		t.Fatalf("red = %+v, want %+v", red, want)
+	}
+}
+
+func TestFromRGBA64MatchesFromSRGB(t *testing.T) {
+	got := FromRGBA64(65535, 0, 0)
+	want := FromSRGB(1, 0, 0)
+	if !approxEqual(got.L, want.L, 1e-6) || !approxEqual(got.A, want.A, 1e-6) || !approxEqual(got.B, want.B, 1e-6) {
+		t.Fatalf("FromRGBA64 = %+v, want %+v", got, want)
+	}
+}
+
+func TestDeltaE76SameColorIsZero(t *testing.T) {
+	c := FromSRGB(0.3, 0.6, 0.9)
+	if d := DeltaE76(c, c); d != 0 {
+		t.Fatalf("DeltaE76(c, c) = %v, want 0", d)
+	}
+}
+
+func TestDeltaE76DifferentColorsAreFartherThanSimilarOnes(t *testing.T) {
+	base := FromSRGB(0.5, 0.5, 0.5)
+	near := FromSRGB(0.51, 0.5, 0.5)
+	far := FromSRGB(1, 0, 0)
+
+	dNear := DeltaE76(base, near)
+	dFar := DeltaE76(base, far)
+	if dNear >= dFar {
+		t.Fatalf("DeltaE76(base, near) = %v, want less than DeltaE76(base, far) = %v", dNear, dFar)
+	}
+}
+
+func TestDeltaE94SameColorIsZero(t *testing.T) {
+	c := FromSRGB(0.2, 0.8, 0.4)
+	if d := DeltaE94(c, c); d != 0 {
+		t.Fatalf("DeltaE94(c, c) = %v, want 0", d)
+	}
+}
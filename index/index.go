@@ -0,0 +1,215 @@
+// Package index stores the analyzed tile library in an embedded key/value
+// store (bbolt) instead of rewriting a single JSON file from scratch on
+// every run. Each tile is keyed by its absolute path, which lets the
+// caller incrementally re-analyze only the files that changed since the
+// last run rather than re-decoding the whole library every time.
+package index
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"time"
+
+	"go.etcd.io/bbolt"
+
+	colorlab "github.com/krpors/mosaic/color/lab"
+)
+
+var tilesBucket = []byte("tiles")
+var metaBucket = []byte("meta")
+
+var gridSizeKey = []byte("gridsize")
+var tileWidthKey = []byte("tilewidth")
+var tileHeightKey = []byte("tileheight")
+
+// Tile is the analyzed signature of a single tile image: its overall
+// sRGB/Lab average color plus, optionally, its NxN subtile-grid signature.
+type Tile struct {
+	Red, Green, Blue, Alpha uint32
+	L, A, B                 float64
+	Grid                    []colorlab.Lab
+}
+
+// Record is a single entry in the index: a tile's signature plus the file
+// metadata needed to tell whether it needs to be re-analyzed.
+type Record struct {
+	Path    string
+	ModTime time.Time
+	Size    int64
+	SHA1    string
+	Tile    Tile
+}
+
+// Index is an embedded, on-disk key/value store of Records, keyed by
+// absolute file path.
+type Index struct {
+	db *bbolt.DB
+}
+
+// Open opens (creating if necessary) the bbolt database at path.
+func Open(path string) (*Index, error) {
+	db, err := bbolt.Open(path, 0600, &bbolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bbolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(tilesBucket); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucketIfNotExists(metaBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &Index{db: db}, nil
+}
+
+// Close closes the underlying database.
+func (ix *Index) Close() error {
+	return ix.db.Close()
+}
+
+// Get returns the record stored for path, if any.
+func (ix *Index) Get(path string) (Record, bool, error) {
+	var rec Record
+	found := false
+
+	err := ix.db.View(func(tx *bbolt.Tx) error {
+		v := tx.Bucket(tilesBucket).Get([]byte(path))
+		if v == nil {
+			return nil
+		}
+		found = true
+		return json.Unmarshal(v, &rec)
+	})
+	return rec, found, err
+}
+
+// Put stores (or overwrites) the record for rec.Path.
+func (ix *Index) Put(rec Record) error {
+	v, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+
+	return ix.db.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket(tilesBucket).Put([]byte(rec.Path), v)
+	})
+}
+
+// Delete removes the record stored for path, if any.
+func (ix *Index) Delete(path string) error {
+	return ix.db.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket(tilesBucket).Delete([]byte(path))
+	})
+}
+
+// ForEach calls fn once per record currently in the index, in key
+// (path) order. Iteration stops if fn returns an error.
+func (ix *Index) ForEach(fn func(Record) error) error {
+	return ix.db.View(func(tx *bbolt.Tx) error {
+		return tx.Bucket(tilesBucket).ForEach(func(k, v []byte) error {
+			var rec Record
+			if err := json.Unmarshal(v, &rec); err != nil {
+				return err
+			}
+			return fn(rec)
+		})
+	})
+}
+
+// Stats summarizes the contents of the index, for `mosaic index stats`.
+type Stats struct {
+	Tiles                 int
+	TotalBytes            int64
+	GridSize              int
+	TileWidth, TileHeight int
+}
+
+// Stats returns summary counts over the whole index.
+func (ix *Index) Stats() (Stats, error) {
+	var s Stats
+
+	gridSize, err := ix.GridSize()
+	if err != nil {
+		return s, err
+	}
+	s.GridSize = gridSize
+
+	s.TileWidth, s.TileHeight, err = ix.TileSize()
+	if err != nil {
+		return s, err
+	}
+
+	err = ix.ForEach(func(rec Record) error {
+		s.Tiles++
+		s.TotalBytes += rec.Size
+		return nil
+	})
+	return s, err
+}
+
+// SetGridSize records the NxN subtile-grid size tiles in this index were
+// analyzed with, so a compose run can tell whether the index it loaded
+// matches the --gridsize it expects.
+func (ix *Index) SetGridSize(n int) error {
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, uint64(n))
+
+	return ix.db.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket(metaBucket).Put(gridSizeKey, buf)
+	})
+}
+
+// GridSize returns the grid size last recorded by SetGridSize, or 0 if
+// none has been set yet.
+func (ix *Index) GridSize() (int, error) {
+	var n int
+
+	err := ix.db.View(func(tx *bbolt.Tx) error {
+		v := tx.Bucket(metaBucket).Get(gridSizeKey)
+		if v == nil {
+			return nil
+		}
+		n = int(binary.BigEndian.Uint64(v))
+		return nil
+	})
+	return n, err
+}
+
+// SetTileSize records the tile width/height tiles in this index were
+// normalized (resized and cropped) to before analysis, so a compose run
+// can tell whether the --tilewidth/--tileheight it's about to draw with
+// matches the region that was actually scored at index time.
+func (ix *Index) SetTileSize(w, h int) error {
+	wbuf := make([]byte, 8)
+	hbuf := make([]byte, 8)
+	binary.BigEndian.PutUint64(wbuf, uint64(w))
+	binary.BigEndian.PutUint64(hbuf, uint64(h))
+
+	return ix.db.Update(func(tx *bbolt.Tx) error {
+		if err := tx.Bucket(metaBucket).Put(tileWidthKey, wbuf); err != nil {
+			return err
+		}
+		return tx.Bucket(metaBucket).Put(tileHeightKey, hbuf)
+	})
+}
+
+// TileSize returns the tile width/height last recorded by SetTileSize, or
+// (0, 0) if none has been set yet.
+func (ix *Index) TileSize() (w, h int, err error) {
+	err = ix.db.View(func(tx *bbolt.Tx) error {
+		if v := tx.Bucket(metaBucket).Get(tileWidthKey); v != nil {
+			w = int(binary.BigEndian.Uint64(v))
+		}
+		if v := tx.Bucket(metaBucket).Get(tileHeightKey); v != nil {
+			h = int(binary.BigEndian.Uint64(v))
+		}
+		return nil
+	})
+	return w, h, err
+}
@@ -0,0 +1,265 @@
+// Package kdtree implements a static, in-memory k-d tree over 3-dimensional
+// points, used by the mosaic composer to find the tile whose average color
+// is nearest to a target cell without falling back to a linear scan over
+// every tile in the index.
+package kdtree
+
+import (
+	"math"
+	"sort"
+)
+
+// Point is a single entry in the tree. Data carries whatever the caller
+// wants to get back out of a query (e.g. a pointer to the tile this point
+// was derived from); the tree itself never looks at it.
+type Point struct {
+	X, Y, Z float64
+	Data    interface{}
+}
+
+type node struct {
+	point       Point
+	axis        int
+	left, right *node
+}
+
+// Tree is a 3-D k-d tree built once over a fixed set of points. It is not
+// safe to mutate concurrently, but concurrent reads (queries) are fine.
+type Tree struct {
+	root *node
+	size int
+}
+
+// New builds a tree from points. The slice is not retained; points are
+// copied into the tree's internal nodes. At each level the splitting axis
+// is chosen as the axis with the largest variance among the points in that
+// subtree, rather than cycling X,Y,Z round-robin, which keeps the tree
+// shallow for color data that is often skewed along one axis (e.g. a tile
+// library dominated by greens).
+func New(points []Point) *Tree {
+	pts := make([]Point, len(points))
+	copy(pts, points)
+	return &Tree{
+		root: build(pts),
+		size: len(pts),
+	}
+}
+
+// Len returns the number of points in the tree.
+func (t *Tree) Len() int {
+	return t.size
+}
+
+func build(pts []Point) *node {
+	if len(pts) == 0 {
+		return nil
+	}
+
+	axis := widestAxis(pts)
+	sort.Slice(pts, func(i, j int) bool {
+		return axisValue(pts[i], axis) < axisValue(pts[j], axis)
+	})
+
+	mid := len(pts) / 2
+	n := &node{
+		point: pts[mid],
+		axis:  axis,
+	}
+	n.left = build(pts[:mid])
+	n.right = build(pts[mid+1:])
+	return n
+}
+
+// widestAxis returns the axis (0=X, 1=Y, 2=Z) along which pts has the
+// largest variance.
+func widestAxis(pts []Point) int {
+	var sum, sumSq [3]float64
+	for _, p := range pts {
+		v := [3]float64{p.X, p.Y, p.Z}
+		for i := 0; i < 3; i++ {
+			sum[i] += v[i]
+			sumSq[i] += v[i] * v[i]
+		}
+	}
+
+	n := float64(len(pts))
+	best := 0
+	var bestVar float64 = -1
+	for i := 0; i < 3; i++ {
+		mean := sum[i] / n
+		variance := sumSq[i]/n - mean*mean
+		if variance > bestVar {
+			bestVar = variance
+			best = i
+		}
+	}
+	return best
+}
+
+func axisValue(p Point, axis int) float64 {
+	switch axis {
+	case 0:
+		return p.X
+	case 1:
+		return p.Y
+	default:
+		return p.Z
+	}
+}
+
+// Nearest returns the point in the tree closest to target under Euclidean
+// distance, along with that distance. If the tree is empty it returns the
+// zero Point and +Inf.
+func (t *Tree) Nearest(target Point) (Point, float64) {
+	best, bestDist := t.NearestFunc(target, nil)
+	return best, bestDist
+}
+
+// NearestFunc is like Nearest, but skips any point for which reject
+// returns true. This is how the mosaic composer implements
+// --no-repeat-radius: reject matches a ring buffer of recently-used tiles
+// without having to remove and re-insert them into the tree.
+//
+// The search descends to the leaf containing target first (following the
+// splitting plane at each node), then unwinds back up to the root. At each
+// node on the way back up, the subtree on the side *not* visited is only
+// explored if the distance from target to the splitting plane is smaller
+// than the best distance found so far -- the standard k-d tree
+// branch-and-bound pruning rule.
+func (t *Tree) NearestFunc(target Point, reject func(Point) bool) (Point, float64) {
+	if t.root == nil {
+		return Point{}, math.Inf(1)
+	}
+
+	best := &searchState{dist: math.Inf(1)}
+	search(t.root, target, reject, best)
+	if best.found {
+		return best.point, math.Sqrt(best.dist)
+	}
+	return best.point, math.Inf(1)
+}
+
+type searchState struct {
+	point Point
+	dist  float64
+	found bool
+}
+
+func search(n *node, target Point, reject func(Point) bool, best *searchState) {
+	if n == nil {
+		return
+	}
+
+	if reject == nil || !reject(n.point) {
+		d := sqDist(n.point, target)
+		if d < best.dist {
+			best.dist = d
+			best.point = n.point
+			best.found = true
+		}
+	}
+
+	axisTarget := axisValue(target, n.axis)
+	axisNode := axisValue(n.point, n.axis)
+
+	near, far := n.left, n.right
+	if axisTarget > axisNode {
+		near, far = n.right, n.left
+	}
+
+	// Descend to the near side first -- it's the side target actually
+	// falls on, so it's the most likely to contain the true nearest point.
+	search(near, target, reject, best)
+
+	// Only bother with the far side if the splitting plane itself is
+	// closer than the best distance found so far; otherwise nothing on
+	// that side can possibly beat what we already have.
+	planeDist := axisTarget - axisNode
+	if planeDist*planeDist < best.dist {
+		search(far, target, reject, best)
+	}
+}
+
+// NearestK returns up to k points closest to target, in ascending order of
+// distance, skipping any point for which reject returns true. It's used to
+// get a shortlist of candidates that a caller then re-ranks by a more
+// expensive (and not necessarily Euclidean) metric -- e.g. the mosaic
+// composer's subtile-grid distance, which isn't a single point this tree
+// could be built on directly.
+func (t *Tree) NearestK(target Point, k int, reject func(Point) bool) []Point {
+	if t.root == nil || k <= 0 {
+		return nil
+	}
+
+	st := &kState{k: k}
+	searchK(t.root, target, reject, st)
+
+	out := make([]Point, len(st.points))
+	copy(out, st.points)
+	return out
+}
+
+type kState struct {
+	k      int
+	points []Point
+	dists  []float64
+}
+
+// insert adds (p, d) into the state's candidate list, keeping it sorted by
+// ascending distance and capped at k entries.
+func (s *kState) insert(p Point, d float64) {
+	i := sort.Search(len(s.dists), func(i int) bool { return s.dists[i] >= d })
+	s.dists = append(s.dists, 0)
+	copy(s.dists[i+1:], s.dists[i:])
+	s.dists[i] = d
+	s.points = append(s.points, Point{})
+	copy(s.points[i+1:], s.points[i:])
+	s.points[i] = p
+
+	if len(s.dists) > s.k {
+		s.dists = s.dists[:s.k]
+		s.points = s.points[:s.k]
+	}
+}
+
+func (s *kState) worst() float64 {
+	if len(s.dists) < s.k {
+		return math.Inf(1)
+	}
+	return s.dists[len(s.dists)-1]
+}
+
+func searchK(n *node, target Point, reject func(Point) bool, st *kState) {
+	if n == nil {
+		return
+	}
+
+	if reject == nil || !reject(n.point) {
+		d := sqDist(n.point, target)
+		if d < st.worst() {
+			st.insert(n.point, d)
+		}
+	}
+
+	axisTarget := axisValue(target, n.axis)
+	axisNode := axisValue(n.point, n.axis)
+
+	near, far := n.left, n.right
+	if axisTarget > axisNode {
+		near, far = n.right, n.left
+	}
+
+	searchK(near, target, reject, st)
+
+	planeDist := axisTarget - axisNode
+	if planeDist*planeDist < st.worst() {
+		searchK(far, target, reject, st)
+	}
+}
+
+func sqDist(a, b Point) float64 {
+	dx := a.X - b.X
+	dy := a.Y - b.Y
+	dz := a.Z - b.Z
+	return dx*dx + dy*dy + dz*dz
+}
@@ -0,0 +1,86 @@
+package kdtree
+
+import (
+	"math"
+	"testing"
+)
+
+func samplePoints() []Point {
+	return []Point{
+		{X: 0, Y: 0, Z: 0, Data: "origin"},
+		{X: 10, Y: 0, Z: 0, Data: "x10"},
+		{X: 0, Y: 10, Z: 0, Data: "y10"},
+		{X: 0, Y: 0, Z: 10, Data: "z10"},
+		{X: 5, Y: 5, Z: 5, Data: "mid"},
+	}
+}
+
+func TestNearestFindsClosestPoint(t *testing.T) {
+	tree := New(samplePoints())
+
+	best, dist := tree.Nearest(Point{X: 1, Y: 1, Z: 1})
+	if best.Data != "origin" {
+		t.Fatalf("got nearest %v, want origin", best.Data)
+	}
+	if want := math.Sqrt(3); math.Abs(dist-want) > 1e-9 {
+		t.Fatalf("got distance %v, want %v", dist, want)
+	}
+}
+
+func TestNearestFuncSkipsRejected(t *testing.T) {
+	tree := New(samplePoints())
+
+	reject := func(p Point) bool { return p.Data == "origin" }
+	best, _ := tree.NearestFunc(Point{X: 1, Y: 1, Z: 1}, reject)
+	if best.Data == "origin" {
+		t.Fatalf("NearestFunc returned a rejected point: %v", best.Data)
+	}
+}
+
+func TestNearestFuncNoCandidatesReturnsInfiniteDistance(t *testing.T) {
+	tree := New(samplePoints())
+
+	rejectAll := func(Point) bool { return true }
+	_, dist := tree.NearestFunc(Point{X: 1, Y: 1, Z: 1}, rejectAll)
+	if !math.IsInf(dist, 1) {
+		t.Fatalf("got distance %v, want +Inf when every candidate is rejected", dist)
+	}
+}
+
+func TestNearestFuncEmptyTreeReturnsInfiniteDistance(t *testing.T) {
+	tree := New(nil)
+
+	_, dist := tree.NearestFunc(Point{X: 1, Y: 1, Z: 1}, nil)
+	if !math.IsInf(dist, 1) {
+		t.Fatalf("got distance %v, want +Inf for an empty tree", dist)
+	}
+}
+
+func TestNearestKOrdersByAscendingDistance(t *testing.T) {
+	tree := New(samplePoints())
+
+	got := tree.NearestK(Point{X: 0, Y: 0, Z: 0}, 3, nil)
+	if len(got) != 3 {
+		t.Fatalf("got %d candidates, want 3", len(got))
+	}
+
+	var lastDist float64 = -1
+	for _, p := range got {
+		d := sqDist(p, Point{X: 0, Y: 0, Z: 0})
+		if d < lastDist {
+			t.Fatalf("NearestK results not sorted by ascending distance: %v", got)
+		}
+		lastDist = d
+	}
+	if got[0].Data != "origin" {
+		t.Fatalf("got closest %v, want origin", got[0].Data)
+	}
+}
+
+func TestNearestKEmptyTreeReturnsNil(t *testing.T) {
+	tree := New(nil)
+
+	if got := tree.NearestK(Point{}, 3, nil); got != nil {
+		t.Fatalf("got %v, want nil for an empty tree", got)
+	}
+}
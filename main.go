@@ -1,20 +1,32 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"flag"
 	"fmt"
 	"image"
 	"image/color"
+	"image/gif"
 	"image/jpeg"
 	"image/png"
+	"io"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"strings"
-)
 
-// Worker pools:
-// http://play.golang.org/p/zfn5t52w4p (laz`)
-// http://play.golang.org/p/ssMGqjQw4q (e-dard)
+	// Registers the WebP decoder with image.Decode; there is no WebP
+	// encoder in the Go ecosystem worth depending on, so writeImage never
+	// produces one.
+	_ "golang.org/x/image/webp"
+
+	colorlab "github.com/krpors/mosaic/color/lab"
+	"github.com/krpors/mosaic/index"
+	"github.com/krpors/mosaic/pool"
+	"github.com/krpors/mosaic/tileprep"
+)
 
 // Calculates the average color used in the specified rectangle in the image.
 func calcAvg(img image.Image, rect image.Rectangle) color.Color {
@@ -107,24 +119,15 @@ func pixelize(img image.Image, rwidth, rheight int) image.Image {
 // obviously an error when the shit hit the fan.
 func openImage(ff string) (image.Image, error) {
 	f, err := os.Open(ff)
-	defer f.Close()
 	if err != nil {
 		return nil, err
 	}
+	defer f.Close()
 
-	var img image.Image
-	if strings.HasSuffix(ff, ".png") {
-		img, err = png.Decode(f)
-	} else if strings.HasSuffix(ff, ".jpg") {
-		img, err = jpeg.Decode(f)
-	} else {
-		return nil, fmt.Errorf("unrecognized image format for file '%s'", ff)
-	}
-
+	img, _, err := image.Decode(f)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("decoding '%s': %w", ff, err)
 	}
-
 	return img, nil
 }
 
@@ -135,20 +138,20 @@ func writeImage(ff string, img image.Image) error {
 	if err != nil {
 		return err
 	}
+	defer of.Close()
 
 	if strings.HasSuffix(ff, ".png") {
-		err = png.Encode(of, img)
-	} else if strings.HasSuffix(ff, ".jpg") {
-		err = jpeg.Encode(of, img, &jpeg.Options{100})
-	} else {
-		err = fmt.Errorf("unrecognized image format '%s'", ff)
+		return png.Encode(of, img)
+	} else if strings.HasSuffix(ff, ".jpg") || strings.HasSuffix(ff, ".jpeg") {
+		return jpeg.Encode(of, img, &jpeg.Options{Quality: 100})
+	} else if strings.HasSuffix(ff, ".gif") {
+		return gif.Encode(of, img, nil)
 	}
-
-	return err
+	return fmt.Errorf("unrecognized image format '%s'", ff)
 }
 
 // Struct containing RGBA values for an image. If err is not nil, the particular
-// instance of this struct should be ignored by analyzeFiles()
+// instance of this struct should be ignored by its caller.
 type imageInfo struct {
 	Path  string
 	Red   uint32
@@ -156,124 +159,525 @@ type imageInfo struct {
 	Blue  uint32
 	Alpha uint32
 
-	// If a file failed to be read, this will be filled and must be discarded.
-	// Since this struct will be sent over a channel, and we cannot send nil
-	// values over this channel, we'll be sending an error in an imageInfo
-	// struct instance instead.
+	// L, A, B are the CIE L*a*b* coordinates of Red/Green/Blue, kept
+	// alongside the sRGB values so mosaic matching can use perceptual
+	// (ΔE) distance instead of Euclidean RGB distance.
+	L float64
+	A float64
+	B float64
+
+	// Grid holds the Lab average of each cell of a GridSize x GridSize
+	// split of the tile, in row-major order, so mosaic matching can score
+	// candidates by more than a single overall average color. Empty when
+	// GridSize is 0.
+	Grid []colorlab.Lab
+
+	// If a file failed to be read, this will be filled and must be
+	// discarded by the caller.
 	err error
 }
 
-// Worker to analyze image files, by calculating the average color for that image.
-// c is channel where files are received on , and result is the channel where the
-// results are sent to.
-func worker(c chan string, result chan imageInfo) {
-	for path := range c {
-		var info imageInfo
-		info.Path = path
+// toTile strips the path and error from info, leaving just the signature
+// that gets stored in the tile index.
+func (info imageInfo) toTile() index.Tile {
+	return index.Tile{
+		Red:   info.Red,
+		Green: info.Green,
+		Blue:  info.Blue,
+		Alpha: info.Alpha,
+		L:     info.L,
+		A:     info.A,
+		B:     info.B,
+		Grid:  info.Grid,
+	}
+}
 
-		img, err := openImage(path)
-		if err != nil {
-			info.err = err
-		} else {
-			avg := calcAvg(img, img.Bounds())
-			r, g, b, _ := color.NRGBAModel.Convert(avg).RGBA()
+// imageInfoFromRecord rebuilds the in-memory imageInfo the mosaic composer
+// works with from a record read out of the tile index.
+func imageInfoFromRecord(rec index.Record) imageInfo {
+	return imageInfo{
+		Path:  rec.Path,
+		Red:   rec.Tile.Red,
+		Green: rec.Tile.Green,
+		Blue:  rec.Tile.Blue,
+		Alpha: rec.Tile.Alpha,
+		L:     rec.Tile.L,
+		A:     rec.Tile.A,
+		B:     rec.Tile.B,
+		Grid:  rec.Tile.Grid,
+	}
+}
 
-			info.Red = r
-			info.Green = g
-			info.Blue = b
-		}
+// analyzeFile computes the signature for a single tile image: its overall
+// average color (in both sRGB and CIE Lab) and, if gridSize > 0, its
+// subtile-grid signature. The image is routed through tileprep.Prepare
+// first, so the signature describes the same EXIF-corrected,
+// smart-cropped, Lanczos-resampled tileW x tileH tile that the mosaic
+// composer will actually draw -- not whatever orientation and aspect
+// ratio the source photo happened to have.
+func analyzeFile(path string, tileW, tileH, gridSize int) imageInfo {
+	var info imageInfo
+	info.Path = path
+
+	img, err := openImage(path)
+	if err != nil {
+		info.err = err
+		return info
+	}
+	img = tileprep.Prepare(img, path, tileW, tileH)
 
-		result <- info
+	avg := calcAvg(img, img.Bounds())
+	r, g, b, _ := color.NRGBAModel.Convert(avg).RGBA()
+
+	info.Red = r
+	info.Green = g
+	info.Blue = b
+
+	lab := colorlab.FromRGBA64(r, g, b)
+	info.L = lab.L
+	info.A = lab.A
+	info.B = lab.B
+
+	if gridSize > 0 {
+		info.Grid = computeGrid(img, img.Bounds(), gridSize)
 	}
+
+	return info
 }
 
-// Iterates over the 'files' slice, and finds per file the average color used.
-// The analyzing happens in parallel, over separate goroutines ('workers'):
+// sha1File returns the hex-encoded SHA-1 digest of the file at path.
+func sha1File(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha1.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// computeGrid splits rect into an n x n grid of equally-sized sub-cells
+// (the last row/column absorbing any remainder) and returns the Lab
+// average color of each, in row-major order. It's used both to build a
+// tile's signature and, with rect set to a single mosaic cell, to build
+// the matching signature for the target image.
+func computeGrid(img image.Image, rect image.Rectangle, n int) []colorlab.Lab {
+	cellW := rect.Dx() / n
+	cellH := rect.Dy() / n
+
+	grid := make([]colorlab.Lab, 0, n*n)
+	for gy := 0; gy < n; gy++ {
+		for gx := 0; gx < n; gx++ {
+			x0 := rect.Min.X + gx*cellW
+			y0 := rect.Min.Y + gy*cellH
+			x1 := x0 + cellW
+			y1 := y0 + cellH
+			if gx == n-1 {
+				x1 = rect.Max.X
+			}
+			if gy == n-1 {
+				y1 = rect.Max.Y
+			}
+
+			avg := calcAvg(img, image.Rect(x0, y0, x1, y1))
+			r, g, b, _ := avg.RGBA()
+			grid = append(grid, colorlab.FromRGBA64(r, g, b))
+		}
+	}
+	return grid
+}
+
+// analyzeToIndex walks dir and, for every file whose (mtime, size) differs
+// from what's already stored in idx (or that isn't in idx at all), decodes
+// it, computes its signature, and stores the result. Files that are
+// already up to date are left untouched, so repeated runs over a growing
+// photo library only pay the decode cost for what actually changed.
 //
-// 1. An x amount of worker goroutines are spawned (the worker() function), using
-//    two channels: a fileChan to 'send' the files to, so the worker 'picks them up',
-//    and a resultChan, where the results of the worker are sent to.
-// 2. A goroutine is created which reads from the resultChan, which receives results
-//	  once they are ready.
-// 3. The files are sent to the fileChan
-// 4. The fileChan is closed to prevent deadlock
-// 5. Once all results are read in the goroutine from step 2, the cumulative results
-//    are sent to the doneChan channel.
+// The analysis is spread across workers worker goroutines (0 defaults to
+// runtime.NumCPU()) reading from a channel buffered to queueDepth, via
+// pool.Pool; ctx is checked between files, so an interrupted run stops
+// feeding new work promptly instead of running every queued file to
+// completion. Each worker writes its own result straight to idx as soon as
+// it's computed -- idx.Put serializes internally, so there's no separate
+// writer goroutine or in-memory accumulation of results. If progress is
+// non-nil, a pool.Progress snapshot is sent on it roughly every 100ms.
 //
-// TODO: make the amount of workers configurable?
-func analyzeFiles(files []string) {
-	// temporary container struct to serialize images to JSON
-	type container struct {
-		Info []imageInfo
-	}
-
-	fileChan := make(chan string)      // used to send the files to the workers
-	resultChan := make(chan imageInfo) // used to receive individual results
-	doneChan := make(chan container)   // used to post the cumulative result
-
-	// Create the workers here, and spawn them, wait for work to do.
-	maxjobs := 3
-	for i := 0; i < maxjobs; i++ {
-		go worker(fileChan, resultChan)
-	}
-
-	// Seperate goroutine to receive results from worker, thanks laz` and e-dard
-	go func() {
-		cont := container{}
-		for _ = range files {
-			info := <-resultChan
-			if info.err != nil {
-				fmt.Println(info.err)
-			} else {
-				fmt.Printf("Processed file '%v'\n", info.Path)
-				cont.Info = append(cont.Info, info)
+// It returns one error per file that failed to analyze or store, in no
+// particular order; a non-nil return does not mean the whole run failed,
+// only that some subset of files wasn't indexed.
+func analyzeToIndex(ctx context.Context, dir string, idx *index.Index, tileW, tileH, workers, queueDepth int, progress chan<- pool.Progress) (total int, failed []error, err error) {
+	var toProcess []string
+
+	wf := func(path string, fi os.FileInfo, err error) error {
+		if err != nil || fi.IsDir() {
+			return nil
+		}
+
+		abs, err := filepath.Abs(path)
+		if err != nil {
+			return nil
+		}
+
+		existing, ok, err := idx.Get(abs)
+		if err == nil && ok && existing.ModTime.Equal(fi.ModTime()) && existing.Size == fi.Size() {
+			return nil // unchanged since the last index run
+		}
+
+		toProcess = append(toProcess, abs)
+		return nil
+	}
+
+	if err := filepath.Walk(dir, wf); err != nil {
+		return 0, nil, err
+	}
+
+	if len(toProcess) == 0 {
+		if progress != nil {
+			close(progress)
+		}
+		return 0, nil, nil
+	}
+
+	gridSize, err := idx.GridSize()
+	if err != nil {
+		if progress != nil {
+			close(progress)
+		}
+		return 0, nil, err
+	}
+
+	work := func(ctx context.Context, path string) error {
+		info := analyzeFile(path, tileW, tileH, gridSize)
+		if info.err != nil {
+			return info.err
+		}
+
+		sum, err := sha1File(info.Path)
+		if err != nil {
+			return err
+		}
+
+		stat, err := os.Stat(info.Path)
+		if err != nil {
+			return err
+		}
+
+		return idx.Put(index.Record{
+			Path:    info.Path,
+			ModTime: stat.ModTime(),
+			Size:    stat.Size(),
+			SHA1:    sum,
+			Tile:    info.toTile(),
+		})
+	}
+
+	errs := pool.New(workers, queueDepth).Run(ctx, toProcess, work, progress)
+	return len(toProcess), errs, nil
+}
+
+// runIndex handles the `mosaic index <add|prune|stats>` subcommands.
+func runIndex(args []string) {
+	if len(args) == 0 {
+		fmt.Println("usage: mosaic index <add|prune|stats> [flags]")
+		os.Exit(1)
+	}
+
+	switch args[0] {
+	case "add":
+		fs := flag.NewFlagSet("index add", flag.ExitOnError)
+		dbPath := fs.String("db", "tiles.db", "path to the tile index database")
+		gridSize := fs.Int("gridsize", 3, "size of the NxN subtile grid computed per tile (0 disables it)")
+		tileWidth := fs.Int("tilewidth", 32, "width in pixels tiles are normalized to before analysis")
+		tileHeight := fs.Int("tileheight", 32, "height in pixels tiles are normalized to before analysis")
+		workers := fs.Int("workers", 0, "number of files to analyze concurrently (0 defaults to runtime.NumCPU())")
+		queueDepth := fs.Int("queuedepth", 0, "how many files may be queued ahead of the workers (0 defaults to -workers)")
+		fs.Parse(args[1:])
+
+		if fs.NArg() < 1 {
+			fmt.Println("index add: missing <dir>")
+			os.Exit(1)
+		}
+
+		if *tileWidth <= 0 || *tileHeight <= 0 {
+			fmt.Printf("index add: -tilewidth/-tileheight must be positive, got %d/%d\n", *tileWidth, *tileHeight)
+			os.Exit(1)
+		}
+
+		if *gridSize > *tileWidth || *gridSize > *tileHeight {
+			fmt.Printf("index add: -gridsize %d can't exceed -tilewidth/-tileheight (%d/%d); each subtile cell would be zero pixels wide\n",
+				*gridSize, *tileWidth, *tileHeight)
+			os.Exit(1)
+		}
+
+		idx, err := index.Open(*dbPath)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		defer idx.Close()
+
+		existingGridSize, err := idx.GridSize()
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+
+		gridSizeSet := false
+		fs.Visit(func(f *flag.Flag) {
+			if f.Name == "gridsize" {
+				gridSizeSet = true
+			}
+		})
+
+		switch {
+		case existingGridSize == 0:
+			// First `index add` against this database: record whatever
+			// grid size this run uses.
+			if err := idx.SetGridSize(*gridSize); err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+		case gridSizeSet && *gridSize != existingGridSize:
+			fmt.Printf("index add: -gridsize %d conflicts with this index's existing grid size %d; rebuild the index or omit -gridsize to keep using it\n", *gridSize, existingGridSize)
+			os.Exit(1)
+		default:
+			// Don't silently reset an established index's grid size back
+			// to the flag's default just because the caller didn't repeat it.
+			*gridSize = existingGridSize
+		}
+
+		existingTileWidth, existingTileHeight, err := idx.TileSize()
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+
+		tileSizeSet := false
+		fs.Visit(func(f *flag.Flag) {
+			if f.Name == "tilewidth" || f.Name == "tileheight" {
+				tileSizeSet = true
+			}
+		})
+
+		switch {
+		case existingTileWidth == 0 && existingTileHeight == 0:
+			// First `index add` against this database: record whatever
+			// tile size this run analyzes at.
+			if err := idx.SetTileSize(*tileWidth, *tileHeight); err != nil {
+				fmt.Println(err)
+				os.Exit(1)
 			}
+		case tileSizeSet && (*tileWidth != existingTileWidth || *tileHeight != existingTileHeight):
+			fmt.Printf("index add: -tilewidth/-tileheight %d/%d conflicts with this index's existing tile size %d/%d; rebuild the index or omit -tilewidth/-tileheight to keep using it\n",
+				*tileWidth, *tileHeight, existingTileWidth, existingTileHeight)
+			os.Exit(1)
+		default:
+			// Don't silently reset an established index's tile size back
+			// to the flags' defaults just because the caller didn't repeat them.
+			*tileWidth, *tileHeight = existingTileWidth, existingTileHeight
 		}
-		// send the cumulative results to the done channel, so the function
-		// can finish up.
-		doneChan <- cont
-	}()
 
-	// Send each path to the worker:
-	for _, path := range files {
-		fileChan <- path
+		ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+		defer cancel()
+
+		progress := make(chan pool.Progress)
+		go func() {
+			for p := range progress {
+				fmt.Printf("\rindexed %d/%d  %s", p.Done, p.Total, p.LastPath)
+			}
+			fmt.Println()
+		}()
+
+		total, errs, err := analyzeToIndex(ctx, fs.Arg(0), idx, *tileWidth, *tileHeight, *workers, *queueDepth, progress)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		if total == 0 {
+			fmt.Println("index add: nothing new or changed")
+			break
+		}
+		for _, e := range errs {
+			fmt.Println(e)
+		}
+		fmt.Printf("index add: %d/%d failed\n", len(errs), total)
+
+	case "prune":
+		fs := flag.NewFlagSet("index prune", flag.ExitOnError)
+		dbPath := fs.String("db", "tiles.db", "path to the tile index database")
+		fs.Parse(args[1:])
+
+		idx, err := index.Open(*dbPath)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		defer idx.Close()
+
+		var stale []string
+		err = idx.ForEach(func(rec index.Record) error {
+			if _, statErr := os.Stat(rec.Path); os.IsNotExist(statErr) {
+				stale = append(stale, rec.Path)
+			}
+			return nil
+		})
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+
+		for _, path := range stale {
+			if err := idx.Delete(path); err != nil {
+				fmt.Println(err)
+				continue
+			}
+			fmt.Printf("pruned '%s'\n", path)
+		}
+		fmt.Printf("index prune: removed %d entr(ies)\n", len(stale))
+
+	case "stats":
+		fs := flag.NewFlagSet("index stats", flag.ExitOnError)
+		dbPath := fs.String("db", "tiles.db", "path to the tile index database")
+		fs.Parse(args[1:])
+
+		idx, err := index.Open(*dbPath)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		defer idx.Close()
+
+		stats, err := idx.Stats()
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+
+		fmt.Printf("tiles:     %d\n", stats.Tiles)
+		fmt.Printf("total size: %d bytes\n", stats.TotalBytes)
+		fmt.Printf("grid size: %d\n", stats.GridSize)
+		fmt.Printf("tile size: %dx%d\n", stats.TileWidth, stats.TileHeight)
+
+	default:
+		fmt.Printf("index: unknown subcommand '%s'\n", args[0])
+		os.Exit(1)
 	}
+}
 
-	// close the file channel; nothing is to be sent to this channel anymore.
-	// Without this, the runtime will report a deadlock.
-	close(fileChan)
+// runCompose handles the `mosaic compose` subcommand: it loads the tile
+// index, assembles a mosaic from a target image, and writes the result out.
+func runCompose(args []string) {
+	fs := flag.NewFlagSet("compose", flag.ExitOnError)
+	target := fs.String("target", "", "path to the target image to mosaic-ify")
+	dbPath := fs.String("db", "tiles.db", "path to the tile index database")
+	tileWidth := fs.Int("tilewidth", 32, "width in pixels of each tile in the output mosaic")
+	tileHeight := fs.Int("tileheight", 32, "height in pixels of each tile in the output mosaic")
+	output := fs.String("output", "mosaic.png", "path to write the composed mosaic to")
+	noRepeatRadius := fs.Int("no-repeat-radius", 0, "reject a tile reused within this many grid cells (Manhattan distance) of a previous use")
+	stabilityThreshold := fs.Float64("stability-threshold", 2.0, "for an animated (GIF) target, max ΔE76 a cell's color can move and still reuse the previous frame's tile")
+	fs.Parse(args)
+
+	if *target == "" {
+		fmt.Println("compose: -target is required")
+		os.Exit(1)
+	}
 
-	// Finally, wait until everything is done ...
-	allImageInfo := <-doneChan
+	if *tileWidth <= 0 || *tileHeight <= 0 {
+		fmt.Printf("compose: -tilewidth/-tileheight must be positive, got %d/%d\n", *tileWidth, *tileHeight)
+		os.Exit(1)
+	}
 
-	// ... and write it to JSON here.
-	bytes, err := json.MarshalIndent(allImageInfo, "", "  ")
+	idx, err := index.Open(*dbPath)
 	if err != nil {
 		fmt.Println(err)
-		return
+		os.Exit(1)
 	}
+	defer idx.Close()
 
-	of, err := os.Create("output.json")
-	defer of.Close()
+	var tiles []imageInfo
+	err = idx.ForEach(func(rec index.Record) error {
+		tiles = append(tiles, imageInfoFromRecord(rec))
+		return nil
+	})
 	if err != nil {
 		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	gridSize, err := idx.GridSize()
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	if indexTileWidth, indexTileHeight, err := idx.TileSize(); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	} else if indexTileWidth != 0 && (indexTileWidth != *tileWidth || indexTileHeight != *tileHeight) {
+		fmt.Printf("compose: -tilewidth/-tileheight %d/%d don't match the %d/%d tiles were analyzed at; the smart-crop window used to score each tile's signature won't match what's drawn\n",
+			*tileWidth, *tileHeight, indexTileWidth, indexTileHeight)
+		os.Exit(1)
+	}
+
+	if strings.HasSuffix(*target, ".gif") {
+		f, err := os.Open(*target)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		src, err := gif.DecodeAll(f)
+		f.Close()
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+
+		result := buildAnimatedMosaic(src, tiles, *tileWidth, *tileHeight, *noRepeatRadius, gridSize, *stabilityThreshold)
+
+		of, err := os.Create(*output)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		defer of.Close()
+
+		if err := gif.EncodeAll(of, result); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
 		return
 	}
 
-	of.Write(bytes)
+	img, err := openImage(*target)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	result := buildMosaic(img, tiles, *tileWidth, *tileHeight, *noRepeatRadius, gridSize)
+	if err := writeImage(*output, result); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
 }
 
 func main() {
-	files := make([]string, 0)
-	wf := func(path string, fi os.FileInfo, err error) error {
-		if !fi.IsDir() {
-			files = append(files, path)
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "index":
+			runIndex(os.Args[2:])
+			return
+		case "compose":
+			runCompose(os.Args[2:])
+			return
 		}
-
-		return nil
 	}
 
-	filepath.Walk(".", wf)
-
-	analyzeFiles(files)
+	fmt.Println("usage: mosaic index <add|prune|stats> [flags]")
+	fmt.Println("       mosaic compose -target <image> [flags]")
+	os.Exit(1)
 }
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestComputeGridLength(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 12, 12))
+	rect := img.Bounds()
+
+	for n := 1; n <= 4; n++ {
+		grid := computeGrid(img, rect, n)
+		if len(grid) != n*n {
+			t.Errorf("computeGrid(n=%d): got %d cells, want %d", n, len(grid), n*n)
+		}
+	}
+}
+
+func TestComputeGridSplitsDistinctHalves(t *testing.T) {
+	// Left half red, right half blue: a 2x2 grid should see two distinct
+	// colors per row, not an averaged blend.
+	rect := image.Rect(0, 0, 8, 8)
+	img := image.NewRGBA(rect)
+	fillRect(img, image.Rect(0, 0, 3, 7), color.RGBA{R: 255, A: 255})
+	fillRect(img, image.Rect(4, 0, 7, 7), color.RGBA{B: 255, A: 255})
+
+	grid := computeGrid(img, rect, 2)
+	if len(grid) != 4 {
+		t.Fatalf("got %d cells, want 4", len(grid))
+	}
+
+	// Index 0 and 2 are the left column (red-dominant: high a*, positive
+	// b*); index 1 and 3 are the right column (blue-dominant: negative b*).
+	if grid[0].A <= grid[1].A {
+		t.Errorf("left column a* (%v) should read redder than right column a* (%v)", grid[0].A, grid[1].A)
+	}
+	if grid[0].B <= grid[1].B {
+		t.Errorf("left column b* (%v, red/yellow-leaning) should be greater than right column b* (%v, blue-leaning)", grid[0].B, grid[1].B)
+	}
+}
+
+func TestComputeGridRemainderPixelsGoToLastCell(t *testing.T) {
+	// 10 isn't evenly divisible by 3: the last row/column must absorb the
+	// remainder rather than leaving a strip of the image unsampled.
+	rect := image.Rect(0, 0, 10, 10)
+	img := image.NewRGBA(rect)
+	fillRect(img, rect, color.RGBA{R: 128, G: 128, B: 128, A: 255})
+
+	grid := computeGrid(img, rect, 3)
+	if len(grid) != 9 {
+		t.Fatalf("got %d cells, want 9", len(grid))
+	}
+	// A uniformly-gray image should yield (near-)identical cells regardless
+	// of how the remainder pixels were distributed.
+	for i, cell := range grid {
+		if cell.L < grid[0].L-0.5 || cell.L > grid[0].L+0.5 {
+			t.Errorf("cell %d L* = %v, want close to cell 0's %v", i, cell.L, grid[0].L)
+		}
+	}
+
+	// Paint only the remainder column (x = 9) white: it must be sampled by
+	// the last column of cells (2, 5, 8), making them lighter than cell 0.
+	fillRect(img, image.Rect(9, 0, 9, 9), color.RGBA{R: 255, G: 255, B: 255, A: 255})
+	grid = computeGrid(img, rect, 3)
+	for _, i := range []int{2, 5, 8} {
+		if grid[i].L <= grid[0].L+0.5 {
+			t.Errorf("cell %d L* = %v, want lighter than cell 0's %v from the remainder column", i, grid[i].L, grid[0].L)
+		}
+	}
+}
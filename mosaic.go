@@ -0,0 +1,240 @@
+package main
+
+import (
+	"image"
+	"image/draw"
+	"math"
+
+	colorlab "github.com/krpors/mosaic/color/lab"
+	"github.com/krpors/mosaic/kdtree"
+	"github.com/krpors/mosaic/tileprep"
+)
+
+// candidateShortlist is how many of the k-d tree's nearest-by-overall-color
+// matches are re-ranked by subtile-grid distance. Keeping it small bounds
+// the cost of the (more expensive) grid comparison per cell.
+const candidateShortlist = 16
+
+// tilePick records where (in grid coordinates) a tile was last placed, so
+// buildMosaic can enforce --no-repeat-radius without scanning the whole
+// output grid for every cell.
+type tilePick struct {
+	gx, gy int
+	tile   *imageInfo
+}
+
+// buildTileTree indexes tiles by overall Lab color for fast nearest-match
+// lookups. ΔE76 is itself just Euclidean distance in Lab space, so
+// building the tree directly on L,a,b coordinates gives ΔE76 matching
+// without any change to the tree's distance function; this is also why
+// the tree can't be reused as-is for CIE94 or CIEDE2000, whose distance
+// isn't a simple Euclidean metric in any fixed coordinate space.
+func buildTileTree(tiles []imageInfo) *kdtree.Tree {
+	points := make([]kdtree.Point, len(tiles))
+	for i := range tiles {
+		points[i] = kdtree.Point{
+			X:    tiles[i].L,
+			Y:    tiles[i].A,
+			Z:    tiles[i].B,
+			Data: &tiles[i],
+		}
+	}
+	return kdtree.New(points)
+}
+
+// buildMosaic partitions target into a tileW x tileH grid (reusing the same
+// cell-averaging approach as pixelize/calcAvg) and replaces each cell with
+// the best-matching tile from tiles.
+//
+// If gridSize is greater than 1 and tiles carry an NxN Grid signature of
+// that size, the candidateShortlist nearest tiles by overall color are
+// re-ranked by summed squared subtile-grid distance, which is far more
+// discriminating than a single average color; the closest match by
+// overall color remains the fallback for tiles without a usable Grid.
+//
+// If noRepeatRadius is greater than zero, a tile already used within that
+// many grid cells (Manhattan distance) of the current cell is rejected in
+// favor of the next-best match.
+func buildMosaic(target image.Image, tiles []imageInfo, tileW, tileH, noRepeatRadius, gridSize int) image.Image {
+	out, _ := buildMosaicFrame(target, tileW, tileH, noRepeatRadius, gridSize, buildTileTree(tiles), nil, 0)
+	return out
+}
+
+// cellState is a grid cell's matched tile, remembered across frames of an
+// animated mosaic so a near-identical cell in the next frame can reuse it
+// instead of re-querying the k-d tree.
+type cellState struct {
+	lab      colorlab.Lab
+	info     *imageInfo
+	prepared image.Image
+}
+
+// buildMosaicFrame is buildMosaic's underlying implementation, taking an
+// already-built tile tree (so callers composing many frames don't rebuild
+// it each time) and an optional map of the previous frame's per-cell
+// state. Where prev is non-nil and a cell's average color has moved by no
+// more than stabilityThreshold (ΔE76) since the previous frame, the
+// previous frame's tile is reused verbatim rather than re-matched -- this
+// is what keeps an animated mosaic from flickering between near-equally
+// good tiles frame to frame, and it also skips the k-d tree query and
+// tileprep.Prepare call entirely for stable cells.
+//
+// It returns the composed image and the per-cell state to pass as prev for
+// the next frame.
+func buildMosaicFrame(target image.Image, tileW, tileH, noRepeatRadius, gridSize int, tree *kdtree.Tree, prev map[image.Point]cellState, stabilityThreshold float64) (image.Image, map[image.Point]cellState) {
+	bounds := target.Bounds()
+	cols := bounds.Dx() / tileW
+	rows := bounds.Dy() / tileH
+
+	out := image.NewRGBA(image.Rect(0, 0, cols*tileW, rows*tileH))
+	next := make(map[image.Point]cellState, cols*rows)
+
+	// Ring buffer of recently-placed tiles, oldest first, used to satisfy
+	// --no-repeat-radius. Cells are filled in row-major order, so the
+	// earliest cell still within the radius is the one noRepeatRadius rows
+	// directly above, noRepeatRadius*cols picks back; the buffer is trimmed
+	// back to that many entries every cell.
+	// A fresh buffer per frame, since the constraint is spatial within one
+	// frame, not temporal across frames.
+	var recent []tilePick
+
+	for gy := 0; gy < rows; gy++ {
+		for gx := 0; gx < cols; gx++ {
+			cellRect := image.Rect(bounds.Min.X+gx*tileW, bounds.Min.Y+gy*tileH,
+				bounds.Min.X+(gx+1)*tileW, bounds.Min.Y+(gy+1)*tileH)
+
+			avg := calcAvg(target, cellRect)
+			r, g, b, _ := avg.RGBA()
+			curLab := colorlab.FromRGBA64(r, g, b)
+			key := image.Pt(gx, gy)
+
+			var info *imageInfo
+			var prepared image.Image
+
+			if prev != nil {
+				if ps, ok := prev[key]; ok && colorlab.DeltaE76(curLab, ps.lab) <= stabilityThreshold {
+					info = ps.info
+					prepared = ps.prepared
+				}
+			}
+
+			if info == nil {
+				targetPoint := kdtree.Point{X: curLab.L, Y: curLab.A, Z: curLab.B}
+
+				gx, gy := gx, gy // capture for the closure below
+				reject := func(p kdtree.Point) bool {
+					if noRepeatRadius <= 0 {
+						return false
+					}
+					cand := p.Data.(*imageInfo)
+					for _, rp := range recent {
+						if rp.tile == cand && manhattan(rp.gx, rp.gy, gx, gy) <= noRepeatRadius {
+							return true
+						}
+					}
+					return false
+				}
+
+				info = pickTile(tree, targetPoint, target, cellRect, gridSize, reject)
+				if info == nil {
+					continue
+				}
+
+				tileImg, err := openImage(info.Path)
+				if err != nil {
+					// The tile was readable when the index was built; if
+					// it has since vanished, just leave the cell blank
+					// rather than aborting the whole composition.
+					continue
+				}
+				prepared = tileprep.Prepare(tileImg, info.Path, tileW, tileH)
+			}
+
+			dstRect := image.Rect(gx*tileW, gy*tileH, (gx+1)*tileW, (gy+1)*tileH)
+			draw.Draw(out, dstRect, prepared, image.Point{}, draw.Src)
+
+			next[key] = cellState{lab: curLab, info: info, prepared: prepared}
+
+			recent = append(recent, tilePick{gx: gx, gy: gy, tile: info})
+			if noRepeatRadius > 0 {
+				if max := noRepeatRadius * cols; len(recent) > max {
+					recent = recent[len(recent)-max:]
+				}
+			}
+		}
+	}
+
+	return out, next
+}
+
+// pickTile chooses the tile to use for cellRect. With gridSize <= 1 it's
+// just the k-d tree's nearest match by overall Lab color; otherwise it
+// re-ranks a shortlist of the nearest overall matches by subtile-grid
+// distance against the target cell, which is more discriminating than a
+// single average color. It returns nil if no candidate survives reject
+// (or the tree holds no tiles at all), leaving the caller to skip the cell.
+func pickTile(tree *kdtree.Tree, targetPoint kdtree.Point, target image.Image, cellRect image.Rectangle, gridSize int, reject func(kdtree.Point) bool) *imageInfo {
+	if gridSize <= 1 {
+		best, dist := tree.NearestFunc(targetPoint, reject)
+		if math.IsInf(dist, 1) {
+			// No candidate survived `reject` (or the tree is empty): there's
+			// simply nothing to draw for this cell.
+			return nil
+		}
+		return best.Data.(*imageInfo)
+	}
+
+	candidates := tree.NearestK(targetPoint, candidateShortlist, reject)
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	targetGrid := computeGrid(target, cellRect, gridSize)
+
+	// candidates is sorted by ascending overall-color distance, so the
+	// first entry is already the right fallback when no candidate has a
+	// Grid signature matching targetGrid's size.
+	best := candidates[0].Data.(*imageInfo)
+	bestDist := math.Inf(1)
+	for _, c := range candidates {
+		info := c.Data.(*imageInfo)
+		if d := gridDistance(info.Grid, targetGrid); d < bestDist {
+			bestDist = d
+			best = info
+		}
+	}
+	return best
+}
+
+// gridDistance is the sum of squared Lab distances between corresponding
+// cells of two subtile-grid signatures. It returns +Inf if the signatures
+// don't have matching lengths (e.g. a is from an index built with a
+// different --gridsize, or wasn't indexed with one at all).
+func gridDistance(a, b []colorlab.Lab) float64 {
+	if len(a) == 0 || len(a) != len(b) {
+		return math.Inf(1)
+	}
+
+	var sum float64
+	for i := range a {
+		dl := a[i].L - b[i].L
+		da := a[i].A - b[i].A
+		db := a[i].B - b[i].B
+		sum += dl*dl + da*da + db*db
+	}
+	return sum
+}
+
+// manhattan returns the Manhattan distance between two grid coordinates.
+func manhattan(x1, y1, x2, y2 int) int {
+	dx := x1 - x2
+	if dx < 0 {
+		dx = -dx
+	}
+	dy := y1 - y2
+	if dy < 0 {
+		dy = -dy
+	}
+	return dx + dy
+}
+
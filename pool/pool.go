@@ -0,0 +1,136 @@
+// Package pool runs a slice of work items across a fixed number of worker
+// goroutines, reading from a bounded channel so a large job (a 50k-file
+// photo library, say) can't outrun memory, and reporting progress at a
+// rate suitable for driving a CLI progress bar.
+package pool
+
+import (
+	"context"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// progressInterval is how often a Progress snapshot is sent, chosen to be
+// fast enough for a responsive-looking progress bar without flooding the
+// channel on a job made up of many small, fast items.
+const progressInterval = 100 * time.Millisecond
+
+// Progress is a point-in-time snapshot of a Run in flight.
+type Progress struct {
+	Done, Total int
+	LastPath    string
+	LastErr     error
+}
+
+// Pool runs Work funcs across a fixed number of worker goroutines.
+type Pool struct {
+	workers    int
+	queueDepth int
+}
+
+// New returns a Pool with the given number of worker goroutines and item
+// queue depth. workers <= 0 defaults to runtime.NumCPU(); queueDepth <= 0
+// defaults to workers, which is enough to keep every worker fed without
+// letting the feeder run arbitrarily far ahead of them.
+func New(workers, queueDepth int) *Pool {
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	if queueDepth <= 0 {
+		queueDepth = workers
+	}
+	return &Pool{workers: workers, queueDepth: queueDepth}
+}
+
+// Run calls work once per item, spread across the pool's workers, and
+// returns every error it produced. If progress is non-nil, a Progress
+// snapshot is sent on it roughly every 100ms while work is outstanding;
+// progress is closed before Run returns.
+//
+// Run stops feeding new items to workers as soon as ctx is cancelled, but
+// does not interrupt a work call already in progress -- work is
+// responsible for checking ctx itself if individual items can take long
+// enough for that to matter.
+func (p *Pool) Run(ctx context.Context, items []string, work func(ctx context.Context, item string) error, progress chan<- Progress) []error {
+	itemChan := make(chan string, p.queueDepth)
+
+	var wg sync.WaitGroup
+	var done int64
+
+	var mu sync.Mutex
+	var errs []error
+	var lastPath string
+	var lastErr error
+
+	for i := 0; i < p.workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for item := range itemChan {
+				err := work(ctx, item)
+
+				mu.Lock()
+				lastPath = item
+				lastErr = err
+				if err != nil {
+					errs = append(errs, err)
+				}
+				mu.Unlock()
+
+				atomic.AddInt64(&done, 1)
+			}
+		}()
+	}
+
+	go func() {
+		defer close(itemChan)
+		for _, item := range items {
+			select {
+			case itemChan <- item:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	if progress != nil {
+		workDone := make(chan struct{})
+		go func() {
+			wg.Wait()
+			close(workDone)
+		}()
+
+		snapshot := func() Progress {
+			mu.Lock()
+			defer mu.Unlock()
+			return Progress{Done: int(atomic.LoadInt64(&done)), Total: len(items), LastPath: lastPath, LastErr: lastErr}
+		}
+
+		reporterDone := make(chan struct{})
+		go func() {
+			defer close(reporterDone)
+			defer close(progress)
+			ticker := time.NewTicker(progressInterval)
+			defer ticker.Stop()
+
+			for {
+				select {
+				case <-ticker.C:
+					progress <- snapshot()
+				case <-workDone:
+					progress <- snapshot()
+					return
+				}
+			}
+		}()
+		<-reporterDone
+	} else {
+		wg.Wait()
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	return errs
+}
@@ -0,0 +1,135 @@
+package tileprep
+
+import "image"
+
+// SmartCrop crops img to the aspect ratio aspectW:aspectH by picking the
+// crop window, among all windows of that aspect ratio that fit in img,
+// that maximizes local luminance variance -- a coarse stand-in for
+// "interesting content" entropy. This beats a naive center-crop for
+// off-center subjects (a face in the corner of a landscape shot, say).
+//
+// The search only slides the crop window along whichever axis has slack
+// (the image is wider or taller than the target aspect), in fixed steps,
+// which keeps the cost roughly linear in image size rather than
+// quadratic.
+func SmartCrop(img image.Image, aspectW, aspectH int) image.Image {
+	b := img.Bounds()
+	srcW, srcH := b.Dx(), b.Dy()
+
+	cropW, cropH := srcW, srcH
+	switch {
+	case srcW*aspectH > srcH*aspectW:
+		// Image is relatively wider than the target aspect: keep the
+		// full height, narrow the width.
+		cropW = srcH * aspectW / aspectH
+	case srcW*aspectH < srcH*aspectW:
+		// Image is relatively taller than the target aspect.
+		cropH = srcW * aspectH / aspectW
+	default:
+		return img // already the right aspect ratio
+	}
+	if cropW < 1 {
+		cropW = 1
+	}
+	if cropH < 1 {
+		cropH = 1
+	}
+
+	integral := buildSqLumaIntegral(img)
+
+	const steps = 20
+	slackX := srcW - cropW
+	slackY := srcH - cropH
+
+	bestScore := -1.0
+	bestX, bestY := 0, 0
+
+	n := steps
+	if slackX == 0 && slackY == 0 {
+		n = 0
+	}
+	for i := 0; i <= n; i++ {
+		x, y := 0, 0
+		if slackX > 0 {
+			x = slackX * i / steps
+		}
+		if slackY > 0 {
+			y = slackY * i / steps
+		}
+
+		if score := integral.windowVariance(x, y, cropW, cropH); score > bestScore {
+			bestScore = score
+			bestX, bestY = x, y
+		}
+	}
+
+	rect := image.Rect(b.Min.X+bestX, b.Min.Y+bestY, b.Min.X+bestX+cropW, b.Min.Y+bestY+cropH)
+	return cropImage(img, rect)
+}
+
+// sqLumaIntegral is a summed-area table of both luminance and squared
+// luminance over an image, so the variance of any rectangular window can
+// be read off in O(1) via four lookups -- the standard integral-image
+// trick, used here as a cheap local-entropy proxy rather than true
+// entropy.
+type sqLumaIntegral struct {
+	sum, sumSq []float64
+	stride     int
+}
+
+func buildSqLumaIntegral(img image.Image) sqLumaIntegral {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	stride := w + 1
+
+	integral := sqLumaIntegral{
+		sum:    make([]float64, stride*(h+1)),
+		sumSq:  make([]float64, stride*(h+1)),
+		stride: stride,
+	}
+
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			r, g, bl, _ := img.At(b.Min.X+x, b.Min.Y+y).RGBA()
+			// Rec. 601 luma, operating on the 16-bit channel values.
+			luma := 0.299*float64(r) + 0.587*float64(g) + 0.114*float64(bl)
+
+			s := luma + integral.get(integral.sum, x, y+1) + integral.get(integral.sum, x+1, y) - integral.get(integral.sum, x, y)
+			sq := luma*luma + integral.get(integral.sumSq, x, y+1) + integral.get(integral.sumSq, x+1, y) - integral.get(integral.sumSq, x, y)
+			integral.sum[(y+1)*stride+(x+1)] = s
+			integral.sumSq[(y+1)*stride+(x+1)] = sq
+		}
+	}
+
+	return integral
+}
+
+func (t sqLumaIntegral) get(table []float64, x, y int) float64 {
+	return table[y*t.stride+x]
+}
+
+// windowVariance returns the variance of luminance within the w0 x h0
+// window at (x0, y0), computed in O(1) from the integral image.
+func (t sqLumaIntegral) windowVariance(x0, y0, w0, h0 int) float64 {
+	sum := t.get(t.sum, x0+w0, y0+h0) - t.get(t.sum, x0, y0+h0) - t.get(t.sum, x0+w0, y0) + t.get(t.sum, x0, y0)
+	sumSq := t.get(t.sumSq, x0+w0, y0+h0) - t.get(t.sumSq, x0, y0+h0) - t.get(t.sumSq, x0+w0, y0) + t.get(t.sumSq, x0, y0)
+
+	n := float64(w0 * h0)
+	if n == 0 {
+		return 0
+	}
+	mean := sum / n
+	return sumSq/n - mean*mean
+}
+
+// cropImage returns the pixels of img within rect as a new RGBA image
+// with its origin reset to (0, 0).
+func cropImage(img image.Image, rect image.Rectangle) image.Image {
+	out := image.NewRGBA(image.Rect(0, 0, rect.Dx(), rect.Dy()))
+	for y := 0; y < rect.Dy(); y++ {
+		for x := 0; x < rect.Dx(); x++ {
+			out.Set(x, y, img.At(rect.Min.X+x, rect.Min.Y+y))
+		}
+	}
+	return out
+}
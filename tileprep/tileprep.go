@@ -0,0 +1,18 @@
+// Package tileprep normalizes a source photo into a tile of a fixed size:
+// it corrects EXIF orientation, crops to the target aspect ratio (picking
+// the highest-variance window rather than a naive center-crop), and
+// resamples to the exact target dimensions with a Lanczos-3 filter. Both
+// the analyze step and the mosaic composer route tiles through this
+// pipeline so every tile being compared or drawn has gone through the
+// same normalization.
+package tileprep
+
+import "image"
+
+// Prepare normalizes img (decoded from the file at path, used only to read
+// the EXIF orientation tag) into a w by h tile.
+func Prepare(img image.Image, path string, w, h int) image.Image {
+	img = ApplyOrientation(img, ReadOrientation(path))
+	img = SmartCrop(img, w, h)
+	return Lanczos3Resize(img, w, h)
+}